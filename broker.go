@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Broker serves the token a Refresher is maintaining over a UNIX socket,
+// so subprocesses and nested htshells can fetch a current token without
+// reading the token file directly or racing an in-flight refresh.
+type Broker struct {
+	Refresher  *Refresher
+	SocketPath string
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// tokenResponse is the JSON body served from GET /token.
+type tokenResponse struct {
+	Token string `json:"token"`
+	// Exp is the token's exp claim in Unix seconds, or 0 if unknown.
+	Exp int64 `json:"exp,omitempty"`
+}
+
+// NewBroker returns a Broker that will serve r's token over socketPath.
+func NewBroker(r *Refresher, socketPath string) *Broker {
+	return &Broker{Refresher: r, SocketPath: socketPath}
+}
+
+// Start listens on SocketPath, mode 0600, and serves GET /token in the
+// background until Stop is called.
+func (b *Broker) Start() error {
+	os.Remove(b.SocketPath)
+	l, err := net.Listen("unix", b.SocketPath)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", b.SocketPath, err)
+	}
+	if err := os.Chmod(b.SocketPath, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("setting permissions on %s: %w", b.SocketPath, err)
+	}
+	b.listener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", b.handleToken)
+	b.server = &http.Server{Handler: mux}
+	go b.server.Serve(l)
+	return nil
+}
+
+// Stop shuts down the broker and removes its socket file.
+func (b *Broker) Stop() {
+	if b.server != nil {
+		b.server.Close()
+	}
+	os.Remove(b.SocketPath)
+}
+
+func (b *Broker) handleToken(w http.ResponseWriter, req *http.Request) {
+	tok, err := os.ReadFile(b.Refresher.TokenFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := tokenResponse{Token: strings.TrimSpace(string(tok))}
+	if c := b.Refresher.getClaims(); c != nil {
+		resp.Exp = c.Exp
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// brokerClient is an http.Client that dials a broker's UNIX socket
+// instead of a TCP address.
+func brokerClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+// FetchToken fetches the current token (and its expiry, if known) from
+// the broker listening on socketPath.
+func FetchToken(socketPath string) (token string, exp time.Time, err error) {
+	resp, err := brokerClient(socketPath).Get("http://unix/token")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", time.Time{}, fmt.Errorf("broker returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding broker response: %w", err)
+	}
+	if tr.Exp > 0 {
+		exp = time.Unix(tr.Exp, 0)
+	}
+	return tr.Token, exp, nil
+}
+
+// brokerReachable reports whether a broker is listening on socketPath and
+// answering requests.
+func brokerReachable(socketPath string) bool {
+	if socketPath == "" {
+		return false
+	}
+	_, _, err := FetchToken(socketPath)
+	return err == nil
+}
+
+// BrokerTokenSource is a TokenSource that fetches the token from another
+// htshell's broker instead of acquiring one itself, so nested shells (and
+// any subprocess they spawn) share one refresher and one htgettoken
+// session instead of each running their own.
+type BrokerTokenSource struct {
+	SocketPath string
+}
+
+func (s *BrokerTokenSource) Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error {
+	token, _, err := FetchToken(s.SocketPath)
+	if err != nil {
+		return fmt.Errorf("fetching token from broker %s: %w", s.SocketPath, err)
+	}
+	return writeTokenFileAtomic(tokenFile, []byte(token+"\n"), 0600)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHTGetToken installs a stand-in "htgettoken" on PATH (for the
+// duration of the test) that writes its first argument to
+// BEARER_TOKEN_FILE, so tests can drive the real HTGetTokenSource.Fetch
+// path instead of writeTokenFileAtomic directly.
+func fakeHTGetToken(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf '%s' \"$1\" > \"$BEARER_TOKEN_FILE\"\n"
+	path := filepath.Join(dir, "htgettoken")
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatalf("writing fake htgettoken: %s", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// TestBrokerNoPartialReads simulates a refresher repeatedly rewriting the
+// token file via the real htgettoken fetch path while several readers
+// concurrently fetch it through the broker, and verifies every response
+// is one complete token, never a torn mix of two writes.
+func TestBrokerNoPartialReads(t *testing.T) {
+	fakeHTGetToken(t)
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := writeTokenFileAtomic(tokenFile, []byte("seed\n"), 0600); err != nil {
+		t.Fatalf("seeding token file: %s", err)
+	}
+
+	r := &Refresher{TokenFile: tokenFile}
+	b := NewBroker(r, filepath.Join(dir, "broker.sock"))
+	if err := b.Start(); err != nil {
+		t.Fatalf("starting broker: %s", err)
+	}
+	defer b.Stop()
+
+	const tokenSize = 4096
+	valid := map[string]bool{"seed": true}
+	var validMu sync.Mutex
+	for i := 0; i < 50; i++ {
+		tok := fmt.Sprintf("%0*d\n", tokenSize-1, i)
+		valid[strings.TrimSpace(tok)] = true
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// one writer, continuously replacing the token file by running the
+	// (fake) htgettoken through HTGetTokenSource, same as Refresher does
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		i := 0
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tok := fmt.Sprintf("%0*d\n", tokenSize-1, i%50)
+			src := &HTGetTokenSource{Args: []string{tok}}
+			if err := src.Fetch(context.Background(), tokenFile, false, nil); err != nil {
+				t.Errorf("fetching token: %s", err)
+				return
+			}
+			i++
+		}
+	}()
+
+	// several readers, hammering the broker
+	errCh := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				token, _, err := FetchToken(b.SocketPath)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				validMu.Lock()
+				ok := valid[token]
+				validMu.Unlock()
+				if !ok {
+					errCh <- fmt.Errorf("got torn/invalid token %q", token)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestWriteTokenFileAtomicLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := writeTokenFileAtomic(path, []byte("hello\n"), 0600); err != nil {
+		t.Fatalf("writeTokenFileAtomic: %s", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading dir: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "token" {
+		t.Fatalf("expected only the final token file in %s, got %v", dir, entries)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// runTokenCmd implements the `htshell-token` subcommand: a small client
+// that scripts and tools spawned inside an htshell can call to fetch the
+// current bearer token from the parent's broker instead of reading the
+// token file or spawning their own htgettoken. It's dispatched from main
+// when argv[0] is "htshell-token" (e.g. via a symlink), in the same
+// single-binary style as tools like busybox.
+func runTokenCmd(args []string) int {
+	socketPath := os.Getenv("HTSHELL_TOKEN_SOCKET")
+	if socketPath == "" {
+		fmt.Fprintln(os.Stderr, "htshell-token: HTSHELL_TOKEN_SOCKET is not set; are you running inside htshell?")
+		return 1
+	}
+
+	token, exp, err := FetchToken(socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "htshell-token: %s\n", err)
+		return 1
+	}
+
+	fmt.Println(token)
+	if !exp.IsZero() {
+		fmt.Fprintf(os.Stderr, "htshell-token: token expires at %s\n", exp.Format(time.RFC3339))
+	}
+	return 0
+}
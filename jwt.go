@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtClaims holds the registered JWT claims htshell cares about for
+// scheduling refreshes. Claims are read without verifying the token's
+// signature, since htshell only needs to know when the token it was
+// handed will expire.
+type jwtClaims struct {
+	Exp int64 `json:"exp"`
+	Nbf int64 `json:"nbf"`
+	Iat int64 `json:"iat"`
+}
+
+func (c *jwtClaims) expiry() time.Time {
+	return time.Unix(c.Exp, 0)
+}
+
+// parseJWTClaims reads tokenFile and decodes the claims from the middle
+// ("payload") segment of a JWT. It returns an error if the file doesn't
+// hold a JWT (e.g. an opaque token) or has no exp claim.
+func parseJWTClaims(tokenFile string) (*jwtClaims, error) {
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.TrimSpace(string(b)), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT: expected 3 dot-separated segments, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("decoding JWT payload: %w", err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("decoding JWT claims: %w", err)
+	}
+	if claims.Exp == 0 {
+		return nil, fmt.Errorf("JWT has no exp claim")
+	}
+	return &claims, nil
+}
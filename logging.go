@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// LogLevel is the minimum level emitted by htshell's own logger and
+	// the refresher's log file.
+	LogLevel = new(slog.LevelVar)
+	// LogFormat is "text" or "json".
+	LogFormat = "text"
+	// Quiet suppresses the token source's stdout/stderr during a refresh
+	// unless the refresh fails, in which case it's logged at error level.
+	Quiet = false
+)
+
+func init() {
+	if r, ok := os.LookupEnv("HTSHELL_LOG_LEVEL"); ok {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r)); err != nil {
+			panic(err)
+		}
+		LogLevel.Set(level)
+	}
+
+	if r, ok := os.LookupEnv("HTSHELL_LOG_FORMAT"); ok {
+		switch strings.ToLower(r) {
+		case "text", "json":
+			LogFormat = strings.ToLower(r)
+		default:
+			panic("HTSHELL_LOG_FORMAT must be \"text\" or \"json\", got " + r)
+		}
+	}
+
+	if r, ok := os.LookupEnv("HTSHELL_QUIET"); ok {
+		Quiet = boolish(r)
+	}
+
+	slog.SetDefault(newLogger(os.Stderr))
+}
+
+// newLogger returns a leveled logger writing to w in LogFormat, sharing
+// LogLevel so `HTSHELL_LOG_LEVEL` governs both htshell's own logger and
+// any loggers built for the refresher.
+func newLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: LogLevel}
+	var h slog.Handler
+	if LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(h)
+}
+
+// refreshOutputWriter adapts a TokenSource's stdout/stderr into the
+// refresher's logger. Unless quiet, each line is also logged at debug
+// level as it arrives; regardless of quiet, everything written is
+// buffered so logIfFailed can re-emit it at error level if the refresh
+// that produced it ends up failing, so failure diagnostics are never
+// lost to a level or quiet setting that only suppresses successful runs.
+type refreshOutputWriter struct {
+	log   *slog.Logger
+	quiet bool
+	buf   bytes.Buffer
+}
+
+func (w *refreshOutputWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	if !w.quiet {
+		if line := strings.TrimRight(string(p), "\n"); line != "" {
+			w.log.Debug(line)
+		}
+	}
+	return len(p), nil
+}
+
+// logIfFailed logs the buffered token source output at error level once
+// the refresh is known to have failed; it's a no-op otherwise.
+func (w *refreshOutputWriter) logIfFailed(failed bool) {
+	if failed && w.buf.Len() > 0 {
+		w.log.Error("token source output", "output", strings.TrimRight(w.buf.String(), "\n"))
+	}
+}
+
+// timeSinceMS is a small helper so callers can write
+// `"duration_ms", timeSinceMS(start)` instead of repeating the cast.
+func timeSinceMS(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
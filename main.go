@@ -3,13 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -22,6 +28,9 @@ var (
 	LogAtPrompt = false
 	// prefix displayed on each log line and the prompt
 	LogPrefix = "[htshell] "
+	// how long to wait for an in-flight refresh and the child shell to exit
+	// during shutdown before giving up and exiting anyway
+	ShutdownTimeout = 10 * time.Second
 )
 
 func init() {
@@ -44,7 +53,13 @@ func init() {
 	if r, ok := os.LookupEnv("HTSHELL_PREFIX"); ok {
 		LogPrefix = r
 	}
-	log.SetPrefix(LogPrefix)
+
+	if r, ok := os.LookupEnv("HTSHELL_SHUTDOWN_TIMEOUT"); ok {
+		ShutdownTimeout, err = time.ParseDuration(r)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func boolish(s string) bool {
@@ -56,18 +71,25 @@ func boolish(s string) bool {
 }
 
 func main() {
+	// dispatch to the htshell-token subcommand if invoked as such (e.g.
+	// via a symlink), rather than launching a shell
+	if filepath.Base(os.Args[0]) == "htshell-token" {
+		os.Exit(runTokenCmd(os.Args[1:]))
+	}
+
 	// get user info
 	u, err := user.Current()
 	if err != nil {
-		log.Fatalf("unable to determine current user: %s", err)
+		slog.Error("unable to determine current user", "error", err)
+		os.Exit(1)
 	}
 
 	// create temporary token file
 	tok, err := os.CreateTemp("", fmt.Sprintf("bt_u%s_", u.Uid))
 	if err != nil {
-		log.Fatalf("unable to create token file: %s", err)
+		slog.Error("unable to create token file", "error", err)
+		os.Exit(1)
 	}
-	defer os.Remove(tok.Name()) // delete it when we leave
 	os.Setenv("BEARER_TOKEN_FILE", tok.Name())
 	if ExportBearerToken {
 		os.Setenv("PROMPT_COMMAND", fmt.Sprintf("export BEARER_TOKEN=$(cat %s);%s",
@@ -77,58 +99,188 @@ func main() {
 	// init Refresher
 	rlog, err := os.Create(fmt.Sprintf("%s.log", tok.Name()))
 	if err != nil {
-		log.Fatalf("unable to create refresher log file: %s", err)
+		slog.Error("unable to create refresher log file", "error", err)
+		os.Exit(1)
+	}
+
+	// if we're nested inside another htshell with a reachable broker,
+	// reuse its refresher instead of starting our own htgettoken
+	brokerSocket, inherited := os.LookupEnv("HTSHELL_TOKEN_SOCKET")
+	inherited = inherited && brokerReachable(brokerSocket)
+
+	var src TokenSource
+	if inherited {
+		slog.Info("reusing token broker", "socket", brokerSocket)
+		src = &BrokerTokenSource{SocketPath: brokerSocket}
+	} else {
+		src, err = NewTokenSource()
+		if err != nil {
+			slog.Error("unable to configure token source", "error", err)
+			os.Exit(1)
+		}
 	}
-	defer os.Remove(rlog.Name()) // delete it when we leave
 	r := Refresher{
 		TokenFile: tok.Name(),
-		Log:       log.New(rlog, LogPrefix, log.Ldate|log.Ltime),
-	}
-	if err != nil {
-		log.Fatalf("unable to create refresher: %s", err)
+		Log:       newLogger(rlog),
+		Source:    src,
 	}
 
 	// get initial token
 	// TODO: maybe we should do token discovery first?
 	if err := r.Refresh(true); err != nil {
-		log.Fatalf("unable to get initial token: %s", err)
+		slog.Error("unable to get initial token", "error", err)
+		os.Exit(1)
 	}
 
 	if err := r.Start(RefreshInterval); err != nil {
-		log.Fatalf("unable to start refresher: %s", err)
+		slog.Error("unable to start refresher", "error", err)
+		os.Exit(1)
+	}
+
+	// if we're not already reusing a parent's broker, start our own so
+	// that nested shells and subprocesses can reuse this refresher
+	var broker *Broker
+	if !inherited {
+		sock := os.Getenv("HTSHELL_TOKEN_SOCKET")
+		if sock == "" {
+			sock = fmt.Sprintf("%s/htshell-%s-%d.sock", os.TempDir(), u.Uid, os.Getpid())
+		}
+		broker = NewBroker(&r, sock)
+		if err := broker.Start(); err != nil {
+			slog.Warn("unable to start token broker", "error", err)
+			broker = nil
+		} else {
+			os.Setenv("HTSHELL_TOKEN_SOCKET", sock)
+			slog.Info("token broker listening", "socket", sock)
+		}
 	}
-	defer r.Stop()
 
 	// get the user's current or login shell
 	sh, err := Getsh(u, "/bin/bash")
 	if err != nil {
-		log.Printf("unable to get login shell, using default (%s): %s", sh, err)
+		slog.Warn("unable to get login shell, using default", "default", sh, "error", err)
+	}
+
+	// work out how to prefix the prompt, and optionally show new log
+	// entries at the prompt, for whichever shell the user is running
+	promptLog := ""
+	if LogAtPrompt {
+		promptLog = rlog.Name()
+	} else {
+		slog.Info("refresher and htgettoken logs", "log_file", rlog.Name())
+	}
+	integrator := NewPromptIntegrator(sh)
+	promptEnv, promptArgs, promptCleanup, err := integrator.Configure(LogPrefix, promptLog)
+	if err != nil {
+		slog.Warn("unable to set up prompt integration, falling back to plain PS1", "shell", integrator.Name(), "error", err)
+		promptEnv, promptArgs = []string{"PS1=" + LogPrefix + os.Getenv("PS1")}, nil
 	}
 
 	// create shell command.
 	// TODO: what flags?
-	cmd := exec.Command(sh)
+	cmd := exec.Command(sh, promptArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf(`PS1=%s%s`, LogPrefix, os.Getenv("PS1")))
-	if LogAtPrompt {
-		// show new log entries at prompt
-		// TODO: what if the shell isn't bash?
-		// TODO: maybe better as a function?
-		// TODO: probably better ways to pass messages from the refresher to the user
-		cmd.Env = append(cmd.Env, fmt.Sprintf(`PROMPT_COMMAND=cat %s && truncate -s0 %s;%s`,
-			rlog.Name(), rlog.Name(), os.Getenv("PROMPT_COMMAND")))
-	} else {
-		log.Printf("refresher and htgettoken logs in %s", rlog.Name())
-	}
+	cmd.Env = append(os.Environ(), promptEnv...)
 
 	// run shell
 	if err := cmd.Start(); err != nil {
 		panic(err)
 	}
-	cmd.Wait()
+
+	// forward interactive signals (SIGINT) to the shell without tearing
+	// htshell itself down, since the shell (or whatever it has in its
+	// foreground job) is what should decide how to react; on terminal
+	// signals (SIGTERM, SIGHUP) forward the signal and then run an
+	// ordered shutdown (stop refresher, close log, remove token files)
+	// before exiting with the child's status
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Ignore(syscall.SIGCHLD)
+
+	waitCh := make(chan error, 1)
+	go func() { waitCh <- cmd.Wait() }()
+
+	var waitErr error
+	shuttingDown := false
+	for done := false; !done; {
+		select {
+		case sig := <-sigCh:
+			if cmd.Process != nil {
+				cmd.Process.Signal(sig)
+			}
+			if sig == syscall.SIGINT {
+				slog.Info("forwarding signal to shell", "signal", sig)
+				continue
+			}
+			slog.Info("received signal, shutting down", "signal", sig)
+			shuttingDown = true
+			done = true
+		case waitErr = <-waitCh:
+			done = true
+		}
+	}
+	if shuttingDown {
+		select {
+		case waitErr = <-waitCh:
+		case <-time.After(ShutdownTimeout):
+			slog.Warn("shell did not exit in time, killing it", "timeout", ShutdownTimeout)
+			if cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			waitErr = <-waitCh
+		}
+	}
+
+	shutdown(&r, broker, rlog, tok, promptCleanup)
+
+	os.Exit(exitCode(waitErr))
+}
+
+// shutdown stops the broker (if any) and the refresher and removes the
+// files they were using, bounded by ShutdownTimeout so a wedged
+// htgettoken refresh can't block exit indefinitely. promptCleanup, if
+// non-nil, removes whatever resource the PromptIntegrator's Configure
+// created (a zsh ZDOTDIR tempdir, a generic-shell FIFO, ...). It's safe
+// to call even if some of the setup in main never completed.
+func shutdown(r *Refresher, broker *Broker, rlog, tok *os.File, promptCleanup func()) {
+	if broker != nil {
+		broker.Stop()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(ShutdownTimeout):
+		slog.Warn("refresher did not stop in time, exiting anyway", "timeout", ShutdownTimeout)
+	}
+
+	rlog.Close()
+	os.Remove(rlog.Name())
+	tok.Close()
+	os.Remove(tok.Name())
+
+	if promptCleanup != nil {
+		promptCleanup()
+	}
+}
+
+// exitCode returns the exit code of a shell's Wait error, or 0/1 if it
+// can't be determined.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 1
 }
 
 // Getsh returns the user's current shell (from SHELL), or login shell (from
@@ -152,31 +304,54 @@ func Getsh(u *user.User, fallback string) (string, error) {
 	return string(out[loc+1 : len(out)-1]), nil
 }
 
+// minSkew is the smallest margin Refresher will leave before a token's
+// exp when scheduling the next refresh, so a very short-lived token still
+// gets refreshed with some time to spare.
+const minSkew = 30 * time.Second
+
 // Refresher manages refreshing a bearer token.
 type Refresher struct {
 	TokenFile string
-	Log       *log.Logger
-	wg        sync.WaitGroup
-	cancel    context.CancelFunc
+	Log       *slog.Logger
+	// Source acquires the token on each refresh. If nil, Refresh falls
+	// back to HTGetTokenSource for backwards compatibility.
+	Source TokenSource
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	claimsMu sync.Mutex
+	claims   *jwtClaims // exp/nbf/iat of the last successfully parsed token, if any
+
+	attempt int // consecutive refresh attempts since the last success
 }
 
-// Start a refresher goroutine.
+// Start a refresher goroutine. interval is used as the refresh period for
+// opaque tokens (and as the backoff ceiling on refresh failures); for JWTs
+// the next refresh is instead scheduled from the token's exp claim.
 func (r *Refresher) Start(interval time.Duration) error {
 	if r.Log != nil {
-		r.Log.Printf("refreshing token (%s) every %s", r.TokenFile, interval)
+		r.Log.Info("starting refresher", "token_file", r.TokenFile, "interval", interval.String())
 	}
 	ctx, cancel := context.WithCancel(context.Background())
+	r.ctx = ctx
 	r.cancel = cancel
 	r.wg.Add(1)
 	go func(ctx context.Context) {
 		defer r.wg.Done()
+		timer := time.NewTimer(r.nextInterval(interval))
+		defer timer.Stop()
+		backoff := time.Second
 		for {
 			select {
-			case <-time.After(interval):
-				err := r.Refresh(false)
-				if err != nil && r.Log != nil {
-					r.Log.Printf("error refreshing token: %s", err)
+			case <-timer.C:
+				if err := r.Refresh(false); err != nil {
+					backoff = nextBackoff(backoff, interval)
+					timer.Reset(backoff)
+					continue
 				}
+				backoff = time.Second
+				timer.Reset(r.nextInterval(interval))
 			case <-ctx.Done():
 				return
 			}
@@ -187,25 +362,109 @@ func (r *Refresher) Start(interval time.Duration) error {
 
 // Stop the refresher goroutine.
 func (r *Refresher) Stop() {
-	log.Println("stopping the token refresher...")
+	if r.Log != nil {
+		r.Log.Info("stopping the token refresher")
+	}
 	r.cancel()
 	r.wg.Wait()
 }
 
 // Refresh the bearer token. If interactive is true it pipes input and
-// output to the parent shell, otherwise logs output to its own log file.
+// output to the parent shell, otherwise logs output to its own log file
+// (or buffers it, in Quiet mode, unless the refresh fails). On success it
+// parses the new token as a JWT so Start can schedule the next refresh
+// from its exp claim.
 func (r *Refresher) Refresh(interactive bool) error {
+	start := time.Now()
+	r.attempt++
+	src := r.Source
+	if src == nil {
+		src = &HTGetTokenSource{Args: os.Args[1:]}
+	}
+
+	var rw *refreshOutputWriter
+	var out io.Writer
 	if r.Log != nil {
-		r.Log.Printf("refeshing bearer token (%s)", r.TokenFile)
-	}
-	cmd := exec.Command("htgettoken", os.Args[1:]...)
-	if interactive {
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	} else if r.Log != nil {
-		cmd.Stdout = r.Log.Writer()
-		cmd.Stderr = r.Log.Writer()
-	}
-	return cmd.Run()
+		rw = &refreshOutputWriter{log: r.Log, quiet: Quiet && !interactive}
+		out = rw
+	}
+
+	// before Start has run (e.g. the initial token fetch in main) there's
+	// no cancelable context yet, so fall back to one that can't be
+	// canceled; once running, this lets Stop cancel an in-flight fetch
+	// instead of leaving it as an orphaned process
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := src.Fetch(ctx, r.TokenFile, interactive, out)
+	if rw != nil {
+		rw.logIfFailed(err != nil)
+	}
+	if err != nil {
+		if r.Log != nil {
+			r.Log.Error("refresh failed", "token_file", r.TokenFile,
+				"attempt", r.attempt, "duration_ms", timeSinceMS(start), "error", err)
+		}
+		return err
+	}
+
+	claims, cerr := parseJWTClaims(r.TokenFile)
+	if cerr != nil {
+		if r.Log != nil {
+			r.Log.Info("refreshed token", "token_file", r.TokenFile,
+				"attempt", r.attempt, "duration_ms", timeSinceMS(start), "opaque", true)
+		}
+		r.setClaims(nil)
+	} else {
+		if r.Log != nil {
+			r.Log.Info("refreshed token", "token_file", r.TokenFile,
+				"attempt", r.attempt, "duration_ms", timeSinceMS(start), "exp", claims.expiry().Format(time.RFC3339))
+		}
+		r.setClaims(claims)
+	}
+	r.attempt = 0
+	return nil
+}
+
+func (r *Refresher) setClaims(c *jwtClaims) {
+	r.claimsMu.Lock()
+	defer r.claimsMu.Unlock()
+	r.claims = c
+}
+
+func (r *Refresher) getClaims() *jwtClaims {
+	r.claimsMu.Lock()
+	defer r.claimsMu.Unlock()
+	return r.claims
+}
+
+// nextInterval returns how long to wait before the next refresh: skewed
+// off the last token's exp claim if it parsed as a JWT, or fallback for
+// opaque tokens.
+func (r *Refresher) nextInterval(fallback time.Duration) time.Duration {
+	claims := r.getClaims()
+	if claims == nil {
+		return fallback
+	}
+	lifetime := time.Until(claims.expiry())
+	skew := lifetime / 10
+	if skew < minSkew {
+		skew = minSkew
+	}
+	if next := lifetime - skew; next > 0 {
+		return next
+	}
+	return minSkew
+}
+
+// nextBackoff doubles cur, capped at max, with up to 50% jitter so a
+// wedged token source doesn't retry in lockstep.
+func nextBackoff(cur, max time.Duration) time.Duration {
+	next := cur * 2
+	if next > max || next <= 0 {
+		next = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(next)/2 + 1))
+	return next/2 + jitter
 }
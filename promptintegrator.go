@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// PromptIntegrator configures a shell invocation so its interactive
+// prompt is prefixed with LogPrefix and, optionally, shows new content
+// written to a log file immediately before each prompt (truncating it
+// after). Different shells hook their prompt differently, so each gets
+// its own implementation instead of assuming bash's PROMPT_COMMAND/PS1.
+type PromptIntegrator interface {
+	// Name is the shell's short name, used for logging.
+	Name() string
+	// Configure returns extra environment variables ("KEY=value") and
+	// command-line arguments to pass when invoking the shell. logPath is
+	// empty unless log-at-prompt display is enabled. cleanup is nil
+	// unless Configure created a resource (a tempdir, a FIFO, ...) that
+	// must be removed once the shell exits; callers must call it (if
+	// non-nil) during shutdown, whether or not Configure returned an
+	// error.
+	Configure(prefix, logPath string) (env, args []string, cleanup func(), err error)
+}
+
+// NewPromptIntegrator returns the PromptIntegrator for the shell at sh
+// (as resolved by Getsh), detected from its base name, falling back to a
+// generic POSIX-ish implementation for anything else (dash, ksh, ...).
+func NewPromptIntegrator(sh string) PromptIntegrator {
+	switch filepath.Base(sh) {
+	case "bash":
+		return bashIntegrator{}
+	case "zsh":
+		return zshIntegrator{}
+	case "fish":
+		return fishIntegrator{}
+	default:
+		return genericIntegrator{}
+	}
+}
+
+// bashIntegrator is the original htshell behavior: PS1 for the prefix and
+// PROMPT_COMMAND to cat-and-truncate the log.
+type bashIntegrator struct{}
+
+func (bashIntegrator) Name() string { return "bash" }
+
+func (bashIntegrator) Configure(prefix, logPath string) ([]string, []string, func(), error) {
+	env := []string{fmt.Sprintf("PS1=%s%s", prefix, os.Getenv("PS1"))}
+	if logPath != "" {
+		env = append(env, fmt.Sprintf(`PROMPT_COMMAND=cat %s && truncate -s0 %s;%s`,
+			logPath, logPath, os.Getenv("PROMPT_COMMAND")))
+	}
+	return env, nil, nil, nil
+}
+
+// zshIntegrator prefixes $PROMPT directly, and for log-at-prompt adds a
+// precmd hook via a generated ZDOTDIR that sources the user's real zsh
+// startup files first so their own config still applies.
+type zshIntegrator struct{}
+
+func (zshIntegrator) Name() string { return "zsh" }
+
+func (zshIntegrator) Configure(prefix, logPath string) ([]string, []string, func(), error) {
+	env := []string{fmt.Sprintf("PROMPT=%s%s", prefix, os.Getenv("PROMPT"))}
+	if logPath == "" {
+		return env, nil, nil, nil
+	}
+
+	origZdotdir := os.Getenv("ZDOTDIR")
+	if origZdotdir == "" {
+		origZdotdir = os.Getenv("HOME")
+	}
+	dir, err := os.MkdirTemp("", "htshell-zdotdir-")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("creating zsh prompt-hook dir: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	rc := fmt.Sprintf("[ -f %[1]s/.zshrc ] && source %[1]s/.zshrc\n"+
+		"htshell_log_at_prompt() { [ -s %[2]s ] && cat %[2]s; : > %[2]s }\n"+
+		"precmd_functions+=(htshell_log_at_prompt)\n",
+		shellQuote(origZdotdir), shellQuote(logPath))
+	if err := os.WriteFile(filepath.Join(dir, ".zshrc"), []byte(rc), 0600); err != nil {
+		cleanup()
+		return nil, nil, nil, fmt.Errorf("writing zsh prompt-hook rc: %w", err)
+	}
+	env = append(env, "ZDOTDIR="+dir)
+	return env, nil, cleanup, nil
+}
+
+// fishIntegrator wraps the user's existing fish_prompt function via
+// `fish -C`, since fish has no PROMPT_COMMAND/PS1 equivalent.
+type fishIntegrator struct{}
+
+func (fishIntegrator) Name() string { return "fish" }
+
+func (fishIntegrator) Configure(prefix, logPath string) ([]string, []string, func(), error) {
+	init := fmt.Sprintf(
+		"functions -q fish_prompt; and functions -c fish_prompt __htshell_orig_fish_prompt; "+
+			"function fish_prompt; %s echo -n %s; "+
+			"functions -q __htshell_orig_fish_prompt; and __htshell_orig_fish_prompt; end",
+		logAtPromptFishSnippet(logPath), shellQuote(prefix))
+	return nil, []string{"-C", init}, nil, nil
+}
+
+func logAtPromptFishSnippet(logPath string) string {
+	if logPath == "" {
+		return ""
+	}
+	return fmt.Sprintf("test -s %[1]s; and cat %[1]s; and truncate -s0 %[1]s; ", shellQuote(logPath))
+}
+
+// genericIntegrator is the fallback for shells with no hook htshell knows
+// how to drive directly (dash, ksh, ...). It sets PS1 and, for
+// log-at-prompt, feeds new log content into a FIFO that the shell is
+// expected to drain from a `trap ... DEBUG` or SIGUSR1 handler in its own
+// startup file; htshell can't inject that trap itself since these shells
+// have no generic hook for running arbitrary config.
+type genericIntegrator struct{}
+
+func (genericIntegrator) Name() string { return "generic" }
+
+func (genericIntegrator) Configure(prefix, logPath string) ([]string, []string, func(), error) {
+	env := []string{"PS1=" + prefix + os.Getenv("PS1")}
+	if logPath == "" {
+		return env, nil, nil, nil
+	}
+
+	fifoPath := logPath + ".fifo"
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil && !os.IsExist(err) {
+		return nil, nil, nil, fmt.Errorf("creating log fifo: %w", err)
+	}
+	env = append(env, "HTSHELL_LOG_FIFO="+fifoPath)
+	go feedLogFIFO(logPath, fifoPath)
+	return env, nil, func() { os.Remove(fifoPath) }, nil
+}
+
+// feedLogFIFO waits for a reader to open fifoPath (e.g. the shell's DEBUG
+// trap), then writes and truncates logPath's current contents, forever.
+// It exits once fifoPath can no longer be opened, which happens once the
+// shell (and htshell) exit and the file is removed.
+func feedLogFIFO(logPath, fifoPath string) {
+	for {
+		f, err := os.OpenFile(fifoPath, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		b, err := os.ReadFile(logPath)
+		if err == nil && len(b) > 0 {
+			f.Write(b)
+			os.Truncate(logPath, 0)
+		}
+		f.Close()
+	}
+}
+
+// shellQuote wraps s in single quotes for safe interpolation into a
+// shell command, suitable for POSIX shells and fish alike.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// spawnShellAndRead starts sh with the given integrator's Configure
+// output applied, types input on its pty, and returns everything the
+// shell writes within timeout.
+func spawnShellAndRead(t *testing.T, sh string, env, args []string, input string, timeout time.Duration) string {
+	t.Helper()
+	if _, err := exec.LookPath(sh); err != nil {
+		t.Skipf("%s not installed: %s", sh, err)
+	}
+
+	if filepath.Base(sh) == "bash" {
+		// isolate from the system's rc files, which may clobber PS1
+		// unconditionally and have nothing to do with what we're testing
+		args = append([]string{"--norc", "--noprofile"}, args...)
+	}
+	cmd := exec.Command(sh, args...)
+	cmd.Env = append(os.Environ(), env...)
+	f, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatalf("starting %s in a pty: %s", sh, err)
+	}
+	defer f.Close()
+	defer cmd.Process.Kill()
+
+	if input != "" {
+		if _, err := f.WriteString(input); err != nil {
+			t.Fatalf("writing to %s: %s", sh, err)
+		}
+	}
+
+	out := make(chan string, 1)
+	go func() {
+		var sb strings.Builder
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				sb.Write(buf[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		out <- sb.String()
+	}()
+
+	select {
+	case s := <-out:
+		return s
+	case <-time.After(timeout):
+		return ""
+	}
+}
+
+func TestPromptIntegratorsShowPrefix(t *testing.T) {
+	const prefix = "[htshell-test] "
+	shells := []struct {
+		path       string
+		integrator PromptIntegrator
+	}{
+		{"bash", bashIntegrator{}},
+		{"zsh", zshIntegrator{}},
+		{"fish", fishIntegrator{}},
+	}
+
+	for _, s := range shells {
+		s := s
+		t.Run(s.integrator.Name(), func(t *testing.T) {
+			env, args, cleanup, err := s.integrator.Configure(prefix, "")
+			if cleanup != nil {
+				defer cleanup()
+			}
+			if err != nil {
+				t.Fatalf("Configure: %s", err)
+			}
+			out := spawnShellAndRead(t, s.path, env, args, "exit\n", 5*time.Second)
+			if !strings.Contains(out, strings.TrimSpace(prefix)) {
+				t.Fatalf("expected prompt output to contain %q, got %q", prefix, out)
+			}
+		})
+	}
+}
+
+func TestPromptIntegratorsFlushLogAtPrompt(t *testing.T) {
+	shells := []struct {
+		path       string
+		integrator PromptIntegrator
+	}{
+		{"bash", bashIntegrator{}},
+		{"zsh", zshIntegrator{}},
+		{"fish", fishIntegrator{}},
+	}
+
+	for _, s := range shells {
+		s := s
+		t.Run(s.integrator.Name(), func(t *testing.T) {
+			dir := t.TempDir()
+			logPath := filepath.Join(dir, "refresher.log")
+			const marker = "htshell-test-log-marker"
+			if err := os.WriteFile(logPath, []byte(marker+"\n"), 0600); err != nil {
+				t.Fatalf("writing log file: %s", err)
+			}
+
+			env, args, cleanup, err := s.integrator.Configure("", logPath)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			if err != nil {
+				t.Fatalf("Configure: %s", err)
+			}
+			// an extra blank line forces a second prompt, so the log gets
+			// flushed at least once before we exit
+			out := spawnShellAndRead(t, s.path, env, args, "\nexit\n", 5*time.Second)
+			if !strings.Contains(out, marker) {
+				t.Fatalf("expected prompt output to contain log marker %q, got %q", marker, out)
+			}
+
+			b, err := io.ReadAll(mustOpen(t, logPath))
+			if err != nil {
+				t.Fatalf("reading log file: %s", err)
+			}
+			if strings.TrimSpace(string(b)) != "" {
+				t.Fatalf("expected log file to be truncated after being shown, got %q", string(b))
+			}
+		})
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %s", path, err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenSource acquires or refreshes a bearer token and writes it to
+// tokenFile. If interactive is true, any user interaction it requires
+// (a device code prompt, an htgettoken Vault login, ...) should be done on
+// the process's own stdin/stdout/stderr; otherwise progress and errors
+// should be written to out.
+type TokenSource interface {
+	Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error
+}
+
+// NewTokenSource selects a TokenSource based on HTSHELL_TOKEN_SOURCE
+// (default "htgettoken") and its source-specific environment variables.
+func NewTokenSource() (TokenSource, error) {
+	switch src := os.Getenv("HTSHELL_TOKEN_SOURCE"); strings.ToLower(src) {
+	case "", "htgettoken":
+		return &HTGetTokenSource{Args: os.Args[1:]}, nil
+	case "oidc-agent":
+		account := os.Getenv("HTSHELL_OIDC_AGENT_ACCOUNT")
+		if account == "" {
+			return nil, fmt.Errorf("HTSHELL_OIDC_AGENT_ACCOUNT must be set to use the oidc-agent token source")
+		}
+		return &OIDCAgentSource{Account: account}, nil
+	case "oauth2":
+		return newOAuth2SourceFromEnv()
+	case "file":
+		path := os.Getenv("HTSHELL_TOKEN_SOURCE_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("HTSHELL_TOKEN_SOURCE_FILE must be set to use the file token source")
+		}
+		return &FileSource{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown HTSHELL_TOKEN_SOURCE %q", src)
+	}
+}
+
+// writeTokenFileAtomic writes data to path via a temp file and rename, so
+// concurrent readers (e.g. the broker) always see either the previous
+// complete contents or the new ones, never a partial write.
+func writeTokenFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// HTGetTokenSource acquires a token by running htgettoken, the original
+// (and default) htshell behavior. Args are passed through unchanged, as
+// they were to the htgettoken command before TokenSource existed.
+type HTGetTokenSource struct {
+	Args []string
+}
+
+func (h *HTGetTokenSource) Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error {
+	// htgettoken writes BEARER_TOKEN_FILE directly rather than through
+	// writeTokenFileAtomic, so point it at a scratch file in the same
+	// directory and rename that into place once it's done, so readers of
+	// tokenFile (e.g. the broker) never see a partial write.
+	tmp, err := os.CreateTemp(filepath.Dir(tokenFile), filepath.Base(tokenFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cmd := exec.CommandContext(ctx, "htgettoken", h.Args...)
+	cmd.Env = append(os.Environ(), "BEARER_TOKEN_FILE="+tmp.Name())
+	if interactive {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else if out != nil {
+		cmd.Stdout = out
+		cmd.Stderr = out
+	}
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("reading htgettoken output: %w", err)
+	}
+	return writeTokenFileAtomic(tokenFile, b, 0600)
+}
+
+// OIDCAgentSource fetches a token from an already-running oidc-agent
+// session via `oidc-token`, so users who already authenticate through
+// oidc-agent for other tools can reuse that session here instead of
+// running htgettoken.
+type OIDCAgentSource struct {
+	// Account is the oidc-agent short account name, as passed to
+	// `oidc-gen`/`oidc-token`.
+	Account string
+}
+
+func (o *OIDCAgentSource) Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, "oidc-token", o.Account)
+	cmd.Stdin = os.Stdin
+	if interactive {
+		cmd.Stderr = os.Stderr
+	} else if out != nil {
+		cmd.Stderr = out
+	}
+	token, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("oidc-token: %w", err)
+	}
+	return writeTokenFileAtomic(tokenFile, []byte(strings.TrimSpace(string(token))+"\n"), 0600)
+}
+
+// FileSource just copies an externally-managed token file into tokenFile
+// on every refresh, for setups where some other process (a sidecar, a
+// Vault agent template, ...) is already responsible for keeping a token
+// file fresh and htshell just needs to watch it.
+type FileSource struct {
+	Path string
+}
+
+func (f *FileSource) Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", f.Path, err)
+	}
+	return writeTokenFileAtomic(tokenFile, b, 0600)
+}
+
+// OAuth2Source acquires a token with a generic OAuth2 flow: it reuses a
+// refresh token if one is configured, otherwise it runs the device-code
+// flow, printing the verification URL and user code to out (or stderr if
+// interactive).
+type OAuth2Source struct {
+	Config       oauth2.Config
+	RefreshToken string
+}
+
+func newOAuth2SourceFromEnv() (*OAuth2Source, error) {
+	clientID := os.Getenv("HTSHELL_OAUTH2_CLIENT_ID")
+	tokenURL := os.Getenv("HTSHELL_OAUTH2_TOKEN_URL")
+	deviceAuthURL := os.Getenv("HTSHELL_OAUTH2_DEVICE_AUTH_URL")
+	if clientID == "" || tokenURL == "" {
+		return nil, fmt.Errorf("HTSHELL_OAUTH2_CLIENT_ID and HTSHELL_OAUTH2_TOKEN_URL must be set to use the oauth2 token source")
+	}
+	var scopes []string
+	if s := os.Getenv("HTSHELL_OAUTH2_SCOPES"); s != "" {
+		scopes = strings.Split(s, ",")
+	}
+	return &OAuth2Source{
+		Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("HTSHELL_OAUTH2_CLIENT_SECRET"),
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				TokenURL:      tokenURL,
+				DeviceAuthURL: deviceAuthURL,
+			},
+		},
+		RefreshToken: os.Getenv("HTSHELL_OAUTH2_REFRESH_TOKEN"),
+	}, nil
+}
+
+func (o *OAuth2Source) Fetch(ctx context.Context, tokenFile string, interactive bool, out io.Writer) error {
+	var tok *oauth2.Token
+	var err error
+	switch {
+	case o.RefreshToken != "":
+		tok, err = o.Config.TokenSource(ctx, &oauth2.Token{RefreshToken: o.RefreshToken}).Token()
+		if err == nil {
+			o.RefreshToken = tok.RefreshToken
+		}
+	default:
+		tok, err = o.deviceCodeFetch(ctx, interactive, out)
+	}
+	if err != nil {
+		return fmt.Errorf("oauth2: %w", err)
+	}
+	return writeTokenFileAtomic(tokenFile, []byte(tok.AccessToken+"\n"), 0600)
+}
+
+func (o *OAuth2Source) deviceCodeFetch(ctx context.Context, interactive bool, out io.Writer) (*oauth2.Token, error) {
+	resp, err := o.Config.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("requesting device code: %w", err)
+	}
+
+	w := out
+	if interactive || w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "to authenticate, visit %s and enter code %s\n", resp.VerificationURI, resp.UserCode)
+
+	fetchCtx := ctx
+	if !resp.Expiry.IsZero() {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithDeadline(ctx, resp.Expiry)
+		defer cancel()
+	}
+	tok, err := o.Config.DeviceAccessToken(fetchCtx, resp)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for device authorization: %w", err)
+	}
+	o.RefreshToken = tok.RefreshToken
+	return tok, nil
+}